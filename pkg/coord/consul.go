@@ -0,0 +1,211 @@
+package coord
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Consul talks to a Consul agent over its HTTP API, so that this package
+// does not need to vendor the Consul client library.
+type Consul struct {
+	endpoint string
+	cli      *http.Client
+}
+
+// NewConsul constructs a Backend backed by the given Consul HTTP endpoint
+// (only the first endpoint is used; Consul clients normally talk to a local
+// agent).
+func NewConsul(endpoints []string) *Consul {
+	endpoint := "http://127.0.0.1:8500"
+	if len(endpoints) > 0 {
+		endpoint = endpoints[0]
+	}
+	return &Consul{
+		endpoint: endpoint,
+		cli:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *Consul) kvPut(key string, value []byte, query string) (bool, error) {
+	url := fmt.Sprintf("%s/v1/kv/%s", c.endpoint, key)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(value))
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var ok bool
+	json.NewDecoder(resp.Body).Decode(&ok)
+	return ok, nil
+}
+
+func (c *Consul) kvGet(key string) ([]byte, error) {
+	resp, err := c.cli.Get(fmt.Sprintf("%s/v1/kv/%s", c.endpoint, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var entries []struct {
+		Value string `json:"Value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(entries[0].Value)
+}
+
+func (c *Consul) RegisterNode(addr string) error {
+	_, err := c.kvPut(fmt.Sprintf("cse138/members/%s", addr), []byte(addr), "")
+	return err
+}
+
+func (c *Consul) WatchMembers() (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	go func() {
+		var last string
+		for {
+			resp, err := c.cli.Get(c.endpoint + "/v1/kv/cse138/members/?recurse=true")
+			if err != nil {
+				log.Println("coord/consul: failed to list members:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			var entries []struct {
+				Value string `json:"Value"`
+			}
+			json.NewDecoder(resp.Body).Decode(&entries)
+			resp.Body.Close()
+
+			members := make([]string, 0, len(entries))
+			for _, e := range entries {
+				v, _ := base64.StdEncoding.DecodeString(e.Value)
+				members = append(members, string(v))
+			}
+
+			key := fmt.Sprint(members)
+			if key != last {
+				last = key
+				ch <- members
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+// AcquireLeaderLease creates a Consul session with the given TTL and
+// attempts to acquire the leader key under it, renewing the session
+// periodically to keep the lease alive.
+func (c *Consul) AcquireLeaderLease(addr string, ttl time.Duration) (<-chan bool, error) {
+	ch := make(chan bool, 1)
+
+	sessionReq, err := json.Marshal(map[string]string{"TTL": ttl.String()})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.cli.Post(c.endpoint+"/v1/session/create", "application/json", bytes.NewBuffer(sessionReq))
+	if err != nil {
+		return nil, err
+	}
+	var session struct {
+		ID string `json:"ID"`
+	}
+	json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+
+	go func() {
+		for {
+			won, err := c.kvPut("cse138/leader", []byte(addr), "acquire="+session.ID)
+			if err != nil {
+				log.Println("coord/consul: leader acquire failed:", err)
+				won = false
+			}
+			ch <- won
+
+			renewReq, _ := http.NewRequest(http.MethodPut,
+				c.endpoint+"/v1/session/renew/"+session.ID, nil)
+			c.cli.Do(renewReq)
+
+			time.Sleep(ttl / 2)
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c *Consul) WatchLeader() (<-chan string, error) {
+	ch := make(chan string, 1)
+	go func() {
+		var last string
+		for {
+			raw, err := c.kvGet("cse138/leader")
+			if err != nil {
+				log.Println("coord/consul: failed to fetch leader:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if string(raw) != last {
+				last = string(raw)
+				ch <- last
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+func (c *Consul) PutViewConfig(cfg ViewConfig) error {
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = c.kvPut(viewConfigKey, payload, "")
+	return err
+}
+
+func (c *Consul) WatchViewConfig() (<-chan ViewConfig, error) {
+	ch := make(chan ViewConfig, 1)
+	go func() {
+		var last string
+		for {
+			raw, err := c.kvGet(viewConfigKey)
+			if err != nil {
+				log.Println("coord/consul: failed to fetch view config:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if string(raw) != last && len(raw) > 0 {
+				last = string(raw)
+				var cfg ViewConfig
+				if err := json.Unmarshal(raw, &cfg); err == nil {
+					ch <- cfg
+				}
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+var _ Backend = &Consul{}
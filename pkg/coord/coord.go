@@ -0,0 +1,95 @@
+// Package coord abstracts cluster membership and view-change coordination
+// behind a single Backend interface, following the pattern of stolon's
+// libkv abstraction over etcd/consul/zookeeper. Today membership is a
+// static []string passed at boot and broadcast ad-hoc through
+// /kv-store/view-change; a Backend lets nodes instead discover and react to
+// membership changes pushed through a shared coordination service.
+package coord
+
+import (
+	"errors"
+	"flag"
+	"time"
+)
+
+// ViewConfig describes the cluster's current membership.
+type ViewConfig struct {
+	Replicas []string
+}
+
+// Backend is anything that can track cluster membership, elect a leader and
+// broadcast view changes. Implementations must be safe for concurrent use.
+type Backend interface {
+	// RegisterNode announces that addr is a live member of the cluster.
+	RegisterNode(addr string) error
+
+	// WatchMembers returns a channel that receives the full membership list
+	// every time it changes. The channel is closed if watching fails
+	// permanently.
+	WatchMembers() (<-chan []string, error)
+
+	// AcquireLeaderLease attempts to become leader under addr's name,
+	// renewing the lease every ttl/2. The returned channel receives true
+	// when addr holds the lease and false when it loses or fails to
+	// acquire it.
+	AcquireLeaderLease(addr string, ttl time.Duration) (<-chan bool, error)
+
+	// PutViewConfig publishes a new view for all nodes to pick up.
+	PutViewConfig(cfg ViewConfig) error
+
+	// WatchViewConfig returns a channel that receives the view every time it
+	// changes.
+	WatchViewConfig() (<-chan ViewConfig, error)
+
+	// WatchLeader returns a channel that receives the current leader's
+	// address every time it changes, for nodes (e.g. follower.indexHandler)
+	// that need to proxy to the leader without themselves standing for
+	// election.
+	WatchLeader() (<-chan string, error)
+}
+
+// Config selects and configures a Backend, mirroring stolon's
+// --store-backend/--store-endpoints flags.
+type Config struct {
+	Backend   string // "memory", "etcdv3", or "consul"
+	Endpoints string // comma-separated list of endpoints, backend-specific
+}
+
+// RegisterFlags adds --store-backend and --store-endpoints to fs and returns
+// the Config they populate.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	cfg := &Config{}
+	fs.StringVar(&cfg.Backend, "store-backend", "memory",
+		"coordination backend to use: memory, etcdv3, or consul")
+	fs.StringVar(&cfg.Endpoints, "store-endpoints", "",
+		"comma-separated backend endpoints, e.g. http://127.0.0.1:2379")
+	return cfg
+}
+
+// New constructs the Backend named by cfg.Backend.
+func New(cfg Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return NewMemory(), nil
+	case "etcdv3":
+		return NewEtcd(splitEndpoints(cfg.Endpoints)), nil
+	case "consul":
+		return NewConsul(splitEndpoints(cfg.Endpoints)), nil
+	default:
+		return nil, errors.New("coord: unknown store backend " + cfg.Backend)
+	}
+}
+
+func splitEndpoints(s string) []string {
+	var out []string
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == ',' {
+			if i > start {
+				out = append(out, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return out
+}
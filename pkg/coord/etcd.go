@@ -0,0 +1,289 @@
+package coord
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// viewConfigKey is the etcd/consul key all nodes watch for membership
+// changes, replacing the manual /kv-store/view-change fan-out.
+const viewConfigKey = "cse138/view-config"
+
+// Etcd talks to an etcd v3 cluster over its JSON gRPC-gateway API, so that
+// this package does not need to vendor the etcd client library.
+type Etcd struct {
+	endpoints []string
+	cli       *http.Client
+}
+
+// NewEtcd constructs a Backend backed by the given etcd v3 endpoints
+// (e.g. "http://127.0.0.1:2379").
+func NewEtcd(endpoints []string) *Etcd {
+	return &Etcd{
+		endpoints: endpoints,
+		cli:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (e *Etcd) endpoint() string {
+	if len(e.endpoints) == 0 {
+		return "http://127.0.0.1:2379"
+	}
+	return e.endpoints[0]
+}
+
+func (e *Etcd) post(path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.cli.Post(e.endpoint()+path, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (e *Etcd) put(key string, value []byte) error {
+	return e.post("/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+		"value": base64.StdEncoding.EncodeToString(value),
+	}, nil)
+}
+
+func (e *Etcd) get(key string) ([]byte, error) {
+	var out struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	err := e.post("/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(key)),
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Kvs) == 0 {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(out.Kvs[0].Value)
+}
+
+func (e *Etcd) RegisterNode(addr string) error {
+	return e.put(fmt.Sprintf("cse138/members/%s", addr), []byte(addr))
+}
+
+// WatchMembers polls the members key prefix since the v3 gateway's streaming
+// watch is awkward over plain HTTP; a dedicated watch connection can replace
+// this once the etcd client library is vendored.
+func (e *Etcd) WatchMembers() (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	go func() {
+		var last string
+		for {
+			var out struct {
+				Kvs []struct {
+					Value string `json:"value"`
+				} `json:"kvs"`
+			}
+			err := e.post("/v3/kv/range", map[string]interface{}{
+				"key":       base64.StdEncoding.EncodeToString([]byte("cse138/members/")),
+				"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd("cse138/members/")),
+			}, &out)
+			if err != nil {
+				log.Println("coord/etcd: failed to list members:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			members := make([]string, 0, len(out.Kvs))
+			for _, kv := range out.Kvs {
+				v, _ := base64.StdEncoding.DecodeString(kv.Value)
+				members = append(members, string(v))
+			}
+
+			key := fmt.Sprint(members)
+			if key != last {
+				last = key
+				ch <- members
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+// AcquireLeaderLease grants a real etcd lease bound to ttl and attempts to
+// win the leader key with a put-if-absent transaction under that lease, so
+// two candidates racing a bare get-then-put can no longer both "win": the
+// transaction only succeeds for whichever candidate's put etcd orders first.
+// The lease is kept alive with periodic keepalives once held, so the key
+// expires on its own if this node dies; a failed keepalive drops leadership
+// and re-grants a fresh lease to try again.
+func (e *Etcd) AcquireLeaderLease(addr string, ttl time.Duration) (<-chan bool, error) {
+	ch := make(chan bool, 1)
+
+	go func() {
+		for {
+			leaseID, err := e.grantLease(ttl)
+			if err != nil {
+				log.Println("coord/etcd: failed to grant lease:", err)
+				ch <- false
+				time.Sleep(ttl / 2)
+				continue
+			}
+
+			won, err := e.acquireLeaderKey(addr, leaseID)
+			if err != nil {
+				log.Println("coord/etcd: leader acquire failed:", err)
+			}
+			ch <- won
+
+			for won {
+				time.Sleep(ttl / 2)
+				if err := e.keepAliveLease(leaseID); err != nil {
+					log.Println("coord/etcd: lease keepalive failed, re-acquiring:", err)
+					won = false
+					ch <- false
+				}
+			}
+
+			if err != nil {
+				time.Sleep(ttl / 2)
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// grantLease creates an etcd lease with the given TTL (in seconds) and
+// returns its ID.
+func (e *Etcd) grantLease(ttl time.Duration) (int64, error) {
+	var out struct {
+		ID string `json:"ID"`
+	}
+	if err := e.post("/v3/lease/grant", map[string]interface{}{
+		"TTL": int64(ttl.Seconds()),
+	}, &out); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	if _, err := fmt.Sscanf(out.ID, "%d", &id); err != nil {
+		return 0, fmt.Errorf("coord/etcd: bad lease id %q: %v", out.ID, err)
+	}
+	return id, nil
+}
+
+// keepAliveLease renews leaseID for another TTL period.
+func (e *Etcd) keepAliveLease(leaseID int64) error {
+	return e.post("/v3/lease/keepalive", map[string]interface{}{
+		"ID": fmt.Sprint(leaseID),
+	}, nil)
+}
+
+// acquireLeaderKey wins the leader key iff it is currently absent (create
+// revision 0), atomically binding it to leaseID in the same transaction.
+func (e *Etcd) acquireLeaderKey(addr string, leaseID int64) (bool, error) {
+	var out struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := e.post("/v3/kv/txn", map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":             base64.StdEncoding.EncodeToString([]byte("cse138/leader")),
+			"target":          "CREATE",
+			"create_revision": 0,
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]interface{}{
+				"key":   base64.StdEncoding.EncodeToString([]byte("cse138/leader")),
+				"value": base64.StdEncoding.EncodeToString([]byte(addr)),
+				"lease": leaseID,
+			},
+		}},
+	}, &out)
+	if err != nil {
+		return false, err
+	}
+	return out.Succeeded, nil
+}
+
+func (e *Etcd) WatchLeader() (<-chan string, error) {
+	ch := make(chan string, 1)
+	go func() {
+		var last string
+		for {
+			raw, err := e.get("cse138/leader")
+			if err != nil {
+				log.Println("coord/etcd: failed to fetch leader:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if string(raw) != last {
+				last = string(raw)
+				ch <- last
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+func (e *Etcd) PutViewConfig(cfg ViewConfig) error {
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return e.put(viewConfigKey, payload)
+}
+
+func (e *Etcd) WatchViewConfig() (<-chan ViewConfig, error) {
+	ch := make(chan ViewConfig, 1)
+	go func() {
+		var last string
+		for {
+			raw, err := e.get(viewConfigKey)
+			if err != nil {
+				log.Println("coord/etcd: failed to fetch view config:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if string(raw) != last && len(raw) > 0 {
+				last = string(raw)
+				var cfg ViewConfig
+				if err := json.Unmarshal(raw, &cfg); err == nil {
+					ch <- cfg
+				}
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return ch, nil
+}
+
+// prefixRangeEnd computes etcd's conventional "end of prefix" key, used to
+// express a prefix scan as a [key, range_end) range query.
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+var _ Backend = &Etcd{}
@@ -0,0 +1,139 @@
+package coord
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Backend with no external dependency, useful for
+// single-binary development and tests. Leadership is first-come-first-served
+// among callers in the same process.
+type Memory struct {
+	m        sync.Mutex
+	members  []string
+	view     ViewConfig
+	leader   string
+	memberCh []chan []string
+	viewCh   []chan ViewConfig
+	leaderCh []chan string
+}
+
+// NewMemory constructs an empty in-memory coordination backend.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (b *Memory) RegisterNode(addr string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for _, m := range b.members {
+		if m == addr {
+			return nil
+		}
+	}
+	b.members = append(b.members, addr)
+	b.broadcastMembers()
+	return nil
+}
+
+func (b *Memory) WatchMembers() (<-chan []string, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch := make(chan []string, 1)
+	ch <- append([]string(nil), b.members...)
+	b.memberCh = append(b.memberCh, ch)
+	return ch, nil
+}
+
+func (b *Memory) broadcastMembers() {
+	snapshot := append([]string(nil), b.members...)
+	for _, ch := range b.memberCh {
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+}
+
+func (b *Memory) AcquireLeaderLease(addr string, ttl time.Duration) (<-chan bool, error) {
+	ch := make(chan bool, 1)
+
+	b.m.Lock()
+	if b.leader == "" {
+		b.leader = addr
+	}
+	won := b.leader == addr
+	b.broadcastLeader()
+	b.m.Unlock()
+
+	ch <- won
+	if !won {
+		return ch, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.m.Lock()
+			stillLeader := b.leader == addr
+			b.m.Unlock()
+			select {
+			case ch <- stillLeader:
+			default:
+			}
+			if !stillLeader {
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (b *Memory) broadcastLeader() {
+	for _, ch := range b.leaderCh {
+		select {
+		case ch <- b.leader:
+		default:
+		}
+	}
+}
+
+func (b *Memory) WatchLeader() (<-chan string, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch := make(chan string, 1)
+	ch <- b.leader
+	b.leaderCh = append(b.leaderCh, ch)
+	return ch, nil
+}
+
+func (b *Memory) PutViewConfig(cfg ViewConfig) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.view = cfg
+	for _, ch := range b.viewCh {
+		select {
+		case ch <- cfg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *Memory) WatchViewConfig() (<-chan ViewConfig, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch := make(chan ViewConfig, 1)
+	ch <- b.view
+	b.viewCh = append(b.viewCh, ch)
+	return ch, nil
+}
+
+var _ Backend = &Memory{}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/spencer-p/cse138/pkg/coord"
+	"github.com/spencer-p/cse138/pkg/log"
 	"github.com/spencer-p/cse138/pkg/types"
 
 	"github.com/gorilla/mux"
@@ -26,34 +28,63 @@ const (
 // follower holds all state that a follower needs to operate.
 type follower struct {
 	client http.Client
-	addr   *url.URL
+
+	m    sync.RWMutex
+	addr *url.URL
+}
+
+// setAddr updates the address the follower proxies to. Route sets the initial
+// address directly; setAddr is called any time a coord.Backend reports a new
+// leader.
+func (f *follower) setAddr(addr *url.URL) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.addr = addr
+}
+
+func (f *follower) getAddr() *url.URL {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	a := *f.addr
+	return &a
 }
 
 func (f *follower) indexHandler(w http.ResponseWriter, r *http.Request) {
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = log.NewRequestID()
+	}
+	fields := log.Fields{"request_id": reqID, "path": r.URL.Path}
+
 	requestBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("Failed to read body:", err)
+		fields["error"] = err.Error()
+		log.Warn("failed to read request body", fields)
 		http.Error(w, "Failed to read request", http.StatusInternalServerError)
 		return
 	}
 
-	target := *f.addr
+	target := *f.getAddr()
 	target.Path = path.Join(target.Path, r.URL.Path)
 
 	request, err := http.NewRequest(r.Method,
 		target.String(),
 		bytes.NewBuffer(requestBody))
 	if err != nil {
-		log.Println("Failed to make proxy request:", err)
+		fields["error"] = err.Error()
+		log.Error("failed to make proxy request", fields)
 		http.Error(w, "Failed to make request", http.StatusInternalServerError)
 		return
 	}
 
 	request.Header = r.Header.Clone()
+	request.Header.Set("X-Request-ID", reqID)
 
 	resp, err := f.client.Do(request)
 	if err != nil {
-		log.Println("Failed to do proxy request:", err)
+		fields["error"] = err.Error()
+		fields["target"] = target.String()
+		log.Warn("proxy request failed, presuming leader is down", fields)
 		// Presumably the leader is down.
 		result := types.Response{
 			Status: http.StatusServiceUnavailable,
@@ -67,19 +98,49 @@ func (f *follower) indexHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
-func Route(r *mux.Router, fwd string) error {
+// Route registers a catch-all proxy to fwd. If backend is non-nil, the
+// proxy target is additionally kept in sync with whichever node currently
+// holds the backend's leader lease, so a failover does not require
+// restarting followers with a new --forward address.
+func Route(r *mux.Router, fwd string, backend coord.Backend) error {
 	addr, err := url.Parse(fwd)
 	if err != nil {
 		return fmt.Errorf("Bad forwarding address %q: %v\n", fwd, addr)
 	}
 
-	f := follower{
+	f := &follower{
 		client: http.Client{
 			Timeout: TIMEOUT,
 		},
 		addr: addr,
 	}
 
+	if backend != nil {
+		leaderCh, err := backend.WatchLeader()
+		if err != nil {
+			log.Warn("failed to watch leader, falling back to static forwarding address", log.Fields{"error": err.Error()})
+		} else {
+			go func() {
+				for leader := range leaderCh {
+					if leader == "" {
+						continue
+					}
+					parsed, err := url.Parse(leader)
+					if err != nil || parsed.Host == "" {
+						// A bare host:port, as nodes register themselves.
+						parsed, err = url.Parse("http://" + leader)
+					}
+					if err != nil {
+						log.Warn("ignoring bad leader address", log.Fields{"leader": leader, "error": err.Error()})
+						continue
+					}
+					log.Info("updating forwarding address to leader", log.Fields{"leader": leader})
+					f.setAddr(parsed)
+				}
+			}()
+		}
+	}
+
 	r.PathPrefix("/").Handler(http.HandlerFunc(f.indexHandler))
 	return nil
 }
@@ -2,13 +2,17 @@ package gossip
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"time"
 
+	"github.com/spencer-p/cse138/pkg/log"
 	"github.com/spencer-p/cse138/pkg/store"
 	"github.com/spencer-p/cse138/pkg/util"
 
@@ -36,7 +40,7 @@ func (m *Manager) relayGossip() {
 
 	//defer result somewhere
 	if err != nil {
-		fmt.Println(err)
+		log.Error("failed to marshal vector clock for gossip", log.Fields{"node": m.address, "error": err.Error()})
 	}
 
 	replicaPath := "/kv-store/gossip"
@@ -46,7 +50,7 @@ func (m *Manager) relayGossip() {
 		}
 		target, err := url.Parse(util.CorrectURL(nodeAddr))
 		if err != nil {
-			log.Println("Bad gossip address", nodeAddr)
+			log.Warn("bad gossip address", log.Fields{"node": m.address, "peer": nodeAddr, "error": err.Error()})
 			continue
 		}
 		target.Path = path.Join(target.Path, replicaPath)
@@ -56,7 +60,7 @@ func (m *Manager) relayGossip() {
 			bytes.NewBuffer(jsonVector))
 
 		if err != nil {
-			log.Println("Failed to delivery gossip to ", nodeAddr)
+			log.Warn("failed to deliver gossip", log.Fields{"node": m.address, "peer": nodeAddr, "error": err.Error()})
 			continue
 		}
 
@@ -65,7 +69,8 @@ func (m *Manager) relayGossip() {
 		client := &http.Client{}
 		resp, err := client.Do(request)
 		if err != nil {
-			log.Fatalln(err)
+			log.Error("gossip request failed", log.Fields{"node": m.address, "peer": nodeAddr, "error": err.Error()})
+			continue
 		}
 
 		//write some ack response bullshit with the vector clock
@@ -95,7 +100,186 @@ func (m *Manager) Receive(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// handleMerkleRoot returns the root hash of this node's Merkle anti-entropy
+// tree, for a peer doing a gossip round to check with a single request
+// whether the two stores have diverged at all.
+func (m *Manager) handleMerkleRoot(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"hash": hex.EncodeToString(m.state.MerkleRoot()),
+	})
+}
+
+// handleMerkleNode returns the hash of a tree node (internal or leaf), addressed by
+// the path of 'L'/'R' turns from the root. A peer descends one level at a
+// time, only following paths whose hash disagrees with its own tree.
+func (m *Manager) handleMerkleNode(w http.ResponseWriter, r *http.Request) {
+	nodePath := mux.Vars(r)["path"]
+
+	hash, err := m.state.MerkleNode(nodePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"hash": hex.EncodeToString(hash),
+	})
+}
+
+// handleMerkleBucket returns the full entry set for a single leaf bucket, so
+// a peer that has descended to a mismatched leaf can reconcile just those
+// keys instead of the whole keyspace.
+func (m *Manager) handleMerkleBucket(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bad bucket id", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := m.state.BucketEntries(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+// fetchMerkleNode fetches the hash of the node addressed by nodePath from
+// peer's Merkle tree, using the root endpoint for the empty path.
+func (m *Manager) fetchMerkleNode(peer, nodePath string) ([]byte, error) {
+	target, err := url.Parse(util.CorrectURL(peer))
+	if err != nil {
+		return nil, fmt.Errorf("bad peer address %q: %v", peer, err)
+	}
+	if nodePath == "" {
+		target.Path = path.Join(target.Path, "kv-store/merkle/root")
+	} else {
+		target.Path = path.Join(target.Path, "kv-store/merkle/node", nodePath)
+	}
+
+	resp, err := http.Get(target.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(body.Hash)
+}
+
+// reconcileBucket fetches every entry peer holds for bucket and imports it
+// into the local store, merging by vector clock the same way gossiped
+// writes always have (see Store.ImportEntry).
+func (m *Manager) reconcileBucket(ctx context.Context, peer string, bucket int) error {
+	target, err := url.Parse(util.CorrectURL(peer))
+	if err != nil {
+		return fmt.Errorf("bad peer address %q: %v", peer, err)
+	}
+	target.Path = path.Join(target.Path, "kv-store/merkle/bucket", strconv.Itoa(bucket))
+
+	resp, err := http.Get(target.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var entries []store.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := m.state.ImportEntry(ctx, e); err != nil {
+			log.Warn("failed to import gossiped entry",
+				log.Fields{"node": m.address, "peer": peer, "key": e.Key, "error": err.Error()})
+		}
+	}
+	return nil
+}
+
+// reconcileSubtree descends from nodePath into whichever of its two children
+// disagree with peer's hash, recursing until it reaches a leaf (addressed by
+// a full-depth path), where it reconciles that bucket directly. A node whose
+// hash matches is never descended into, so traffic scales with the size of
+// the actual diff and the tree's depth, not the size of the store.
+func (m *Manager) reconcileSubtree(ctx context.Context, peer, nodePath string) error {
+	if bucket, err := store.BucketForPath(nodePath); err == nil {
+		return m.reconcileBucket(ctx, peer, bucket)
+	}
+
+	for _, turn := range [2]byte{'L', 'R'} {
+		childPath := nodePath + string(turn)
+
+		localHash, err := m.state.MerkleNode(childPath)
+		if err != nil {
+			return err
+		}
+		peerHash, err := m.fetchMerkleNode(peer, childPath)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(localHash, peerHash) {
+			continue
+		}
+		if err := m.reconcileSubtree(ctx, peer, childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileWithPeer runs one Merkle anti-entropy round against peer: it
+// compares root hashes first and only descends the tree (see
+// reconcileSubtree) if they disagree, so two replicas that already match
+// cost a single request to confirm.
+func (m *Manager) reconcileWithPeer(ctx context.Context, peer string) error {
+	peerRoot, err := m.fetchMerkleNode(peer, "")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(peerRoot, m.state.MerkleRoot()) {
+		return nil
+	}
+	return m.reconcileSubtree(ctx, peer, "")
+}
+
+// runMerkleSync reconciles this node's store against every other replica
+// once per interval, so divergence from a missed or dropped gossip message
+// is eventually corrected without resending the whole keyspace.
+func (m *Manager) runMerkleSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+		for _, peer := range m.replicas {
+			if peer == m.address {
+				continue
+			}
+			if err := m.reconcileWithPeer(ctx, peer); err != nil {
+				log.Warn("merkle reconciliation failed", log.Fields{"node": m.address, "peer": peer, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// Start launches the Merkle anti-entropy loop as a background goroutine,
+// reconciling with every replica once per interval.
+func (m *Manager) Start(interval time.Duration) {
+	go m.runMerkleSync(interval)
+}
+
 func (m *Manager) Route(r *mux.Router) {
 
 	r.HandleFunc("/kv-store/gossip", m.Receive).Methods(http.MethodPut)
+
+	r.HandleFunc("/kv-store/merkle/root", m.handleMerkleRoot).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/merkle/node/{path:[LR]*}", m.handleMerkleNode).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/merkle/bucket/{id:[0-9]+}", m.handleMerkleBucket).Methods(http.MethodGet)
 }
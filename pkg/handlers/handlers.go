@@ -2,12 +2,21 @@
 package handlers
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"sync"
 
+	"github.com/spencer-p/cse138/pkg/clock"
+	"github.com/spencer-p/cse138/pkg/coord"
 	"github.com/spencer-p/cse138/pkg/hash"
+	"github.com/spencer-p/cse138/pkg/log"
 	"github.com/spencer-p/cse138/pkg/msg"
+	"github.com/spencer-p/cse138/pkg/raft"
 	"github.com/spencer-p/cse138/pkg/store"
 	"github.com/spencer-p/cse138/pkg/types"
 
@@ -19,19 +28,104 @@ type State struct {
 	hash    hash.Interface
 	address string
 	cli     *http.Client
+
+	// raft is non-nil on every node; it stays in raft.ModeCausal (a no-op
+	// passthrough) until an operator opts a node into linearizable mode via
+	// the admin endpoint below.
+	raft *raft.Node
+
+	// backend is nil unless a coordination backend was configured at boot
+	// (see coord.RegisterFlags), in which case it replaces the manual
+	// /kv-store/view-change fan-out with watches on shared view/membership
+	// state and lease-based leader election.
+	backend coord.Backend
+
+	leaderMu sync.RWMutex
+	isLeader bool
+
+	// membersMu/members cache the backend's latest view of cluster
+	// membership (see watchBackend's WatchMembers goroutine), so a node that
+	// wins the leader lease can publish the membership the backend actually
+	// knows about instead of only the boot-time view it was started with.
+	membersMu sync.Mutex
+	members   []string
+}
+
+// currentMembers returns the most recently observed backend membership, or
+// nil if this node has no backend or hasn't heard from WatchMembers yet.
+func (s *State) currentMembers() []string {
+	s.membersMu.Lock()
+	defer s.membersMu.Unlock()
+	return s.members
+}
+
+// IsLeader reports whether this node currently holds the coordination
+// backend's leader lease. It is always false when no backend is configured.
+func (s *State) IsLeader() bool {
+	s.leaderMu.RLock()
+	defer s.leaderMu.RUnlock()
+	return s.isLeader
+}
+
+func (s *State) setIsLeader(isLeader bool) {
+	s.leaderMu.Lock()
+	defer s.leaderMu.Unlock()
+	s.isLeader = isLeader
+}
+
+// requestContext extracts the caller's X-Request-ID (generating one if the
+// caller did not set it) and attaches it to the request's context, so every
+// log line emitted while handling it - including ones several calls deep in
+// Store.Write/Delete - can be correlated back to the originating request.
+func (s *State) requestContext(r *http.Request) context.Context {
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = log.NewRequestID()
+	}
+	return log.WithRequestID(r.Context(), reqID)
+}
+
+// withContext adapts a handler that wants the request's context.Context into
+// an HTTP handler func, closing over the context and passing the rest through
+// types.ValidateKey and types.WrapHTTP, since types.Input itself carries no
+// context.
+func (s *State) withContext(h func(context.Context, types.Input, *types.Response)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := s.requestContext(r)
+		types.WrapHTTP(types.ValidateKey(func(in types.Input, res *types.Response) {
+			h(ctx, in, res)
+		}))(w, r)
+	}
 }
 
-func (s *State) deleteHandler(in types.Input, res *types.Response) {
+func (s *State) deleteHandler(ctx context.Context, in types.Input, res *types.Response) {
 	if in.Key == "" {
 		res.Error = msg.KeyMissing
 		res.Status = http.StatusBadRequest
 		return
 	}
 
+	if !s.ownsKey(in.Key) {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.MainFailure
+		return
+	}
+
 	_, ok := s.store.Read(in.Key)
 	res.Exists = &ok
 
-	s.store.Delete(in.Key)
+	if s.raft.Mode() == raft.ModeLinearizable {
+		if err := s.raft.Propose(ctx, raft.OpDelete, in.Key, ""); err != nil {
+			if err == raft.ErrNotLeader && s.redirectToLeader(http.MethodDelete, in.Key, "", res) {
+				return
+			}
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.MainFailure
+			return
+		}
+	} else {
+		s.store.Delete(in.Key)
+	}
 
 	if !ok {
 		res.Status = http.StatusNotFound
@@ -54,14 +148,33 @@ func (s *State) getHandler(in types.Input, res *types.Response) {
 	}
 }
 
-func (s *State) putHandler(in types.Input, res *types.Response) {
+func (s *State) putHandler(ctx context.Context, in types.Input, res *types.Response) {
 	if in.Value == "" {
 		res.Error = msg.ValueMissing
 		res.Status = http.StatusBadRequest
 		return
 	}
 
-	replaced := s.store.Set(in.Key, in.Value)
+	if !s.ownsKey(in.Key) {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.MainFailure
+		return
+	}
+
+	var replaced bool
+	if s.raft.Mode() == raft.ModeLinearizable {
+		_, replaced = s.store.Read(in.Key)
+		if err := s.raft.Propose(ctx, raft.OpWrite, in.Key, in.Value); err != nil {
+			if err == raft.ErrNotLeader && s.redirectToLeader(http.MethodPut, in.Key, in.Value, res) {
+				return
+			}
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.MainFailure
+			return
+		}
+	} else {
+		replaced = s.store.Set(in.Key, in.Value)
+	}
 
 	res.Replaced = &replaced
 	res.Message = msg.PutSuccess
@@ -72,30 +185,144 @@ func (s *State) putHandler(in types.Input, res *types.Response) {
 	}
 }
 
-func (s *State) shouldForward(r *http.Request, rm *mux.RouteMatch) bool {
-	key := path.Base(r.URL.Path)
-	nodeAddr, err := s.hash.Get(key)
+// incrementHandler atomically adds the integer delta in in.Value (1 if
+// in.Value is empty) to the integer counter stored at in.Key. It is built on
+// Store.GuaranteedUpdate rather than a Read followed by a putHandler-style
+// Write, so a concurrent increment on this node is never lost to a stale
+// read the way an unconditional overwrite would lose it; cross-node
+// concurrent increments are prevented from racing at all, since
+// /kv-store/counters/ is forwarded to the key's owning node exactly like
+// /kv-store/keys/ (see shouldForward in Route), so only one node ever runs
+// GuaranteedUpdate for a given counter.
+func (s *State) incrementHandler(ctx context.Context, in types.Input, res *types.Response) {
+	if !s.ownsKey(in.Key) {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.MainFailure
+		return
+	}
+
+	delta := 1
+	if in.Value != "" {
+		parsed, err := strconv.Atoi(in.Value)
+		if err != nil {
+			res.Error = msg.BadCounterDelta
+			res.Status = http.StatusBadRequest
+			return
+		}
+		delta = parsed
+	}
+
+	err, result, _ := s.store.GuaranteedUpdate(ctx, clock.VectorClock{}, in.Key,
+		func(current store.Entry) (store.Entry, error) {
+			count := 0
+			if current.Value != "" {
+				count, _ = strconv.Atoi(current.Value)
+			}
+			return store.Entry{Value: strconv.Itoa(count + delta)}, nil
+		})
 	if err != nil {
-		log.Println("Failed to get address for key %q: %v\n", key, err)
-		log.Println("This node will handle the request")
-		return false
+		res.Status = http.StatusInternalServerError
+		res.Error = msg.MainFailure
+		return
 	}
 
-	if nodeAddr == s.address {
-		log.Printf("Key %d is serviced by this node\n")
+	res.Message = msg.PutSuccess
+	res.Value = result.Value
+}
+
+// redirectToLeader proxies a write this node could not Propose (because it
+// is not the raft leader) to the node that is, mirroring the hash-based
+// forwarding shouldForward/forwardMessage already do for keys owned by
+// another node. It reports whether the proxy succeeded in producing a
+// response for res; on false, the caller should fall back to its own error.
+func (s *State) redirectToLeader(method, key, value string, res *types.Response) bool {
+	leader := s.raft.LeaderID()
+	if leader == "" || leader == s.address {
 		return false
+	}
+
+	target := *s.address2url(leader)
+	target.Path = path.Join(target.Path, "kv-store/keys", key)
+
+	var body *bytes.Buffer
+	if method == http.MethodPut {
+		payload, err := json.Marshal(struct {
+			Value string `json:"value"`
+		}{value})
+		if err != nil {
+			return false
+		}
+		body = bytes.NewBuffer(payload)
 	} else {
-		log.Printf("Key %d is serviced by %q\n")
+		body = bytes.NewBuffer(nil)
+	}
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		log.Warn("failed to build leader redirect request", log.Fields{"node": s.address, "leader": leader, "error": err.Error()})
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		log.Warn("leader redirect failed", log.Fields{"node": s.address, "leader": leader, "error": err.Error()})
+		return false
+	}
+	defer resp.Body.Close()
+
+	res.Status = resp.StatusCode
+	json.NewDecoder(resp.Body).Decode(res)
+	return true
+}
+
+// address2url parses addr (a bare host:port, as stored in the raft/hash
+// membership lists) into a URL under the same http:// scheme the rest of
+// this package's client uses to reach other nodes.
+func (s *State) address2url(addr string) *url.URL {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		u = &url.URL{Scheme: "http", Host: addr}
+	}
+	return u
+}
+
+func (s *State) shouldForward(r *http.Request, rm *mux.RouteMatch) bool {
+	key := path.Base(r.URL.Path)
+	if s.ownsKey(key) {
+		log.Debug("key is serviced by this node", log.Fields{"node": s.address, "key": key})
+		return false
+	}
+	log.Debug("key is serviced by another node", log.Fields{"node": s.address, "key": key})
+	return true
+}
+
+// ownsKey reports whether this node is responsible for key according to the
+// hash ring, the same per-shard ownership shouldForward routes requests by.
+// Handlers use it as a last-line defense against reaching a key they don't
+// own (e.g. if a request bypasses the mux-level forwarding, or the route is
+// not registered under shouldForward at all), instead of gating writes on
+// the single cluster-wide backend leader lease, which has nothing to do with
+// which node owns a given key.
+func (s *State) ownsKey(key string) bool {
+	nodeAddr, err := s.hash.Get(key)
+	if err != nil {
+		log.Warn("failed to get address for key, handling locally",
+			log.Fields{"node": s.address, "key": key, "error": err.Error()})
 		return true
 	}
+	return nodeAddr == s.address
 }
 
 func InitNode(r *mux.Router, addr string, view []string) {
-	s := NewState(addr, view)
+	s := NewState(addr, view, nil)
 	s.Route(r)
 }
 
-func NewState(addr string, view []string) *State {
+// NewState constructs a node's handler state. backend may be nil, in which
+// case membership stays static and view changes must still be pushed
+// manually to /kv-store/view-change.
+func NewState(addr string, view []string, backend coord.Backend) *State {
 	s := &State{
 		store:   store.New(),
 		hash:    hash.NewModulo(),
@@ -103,19 +330,148 @@ func NewState(addr string, view []string) *State {
 		cli: &http.Client{
 			Timeout: CLIENT_TIMEOUT,
 		},
+		backend: backend,
 	}
+	s.raft = raft.NewNode(addr, view, s.store)
 
-	log.Println("Adding these node address to members of hash", view)
+	log.Info("adding nodes to hash membership", log.Fields{"node": addr, "view": view})
 	s.hash.Set(view)
 
+	if backend != nil {
+		s.watchBackend()
+	}
+
 	return s
 }
 
+// watchBackend registers this node with the coordination backend and starts
+// goroutines that apply membership and view changes as they are published,
+// and that track whether this node currently holds the shard leader lease.
+func (s *State) watchBackend() {
+	if err := s.backend.RegisterNode(s.address); err != nil {
+		log.Warn("failed to register node with coordination backend",
+			log.Fields{"node": s.address, "error": err.Error()})
+	}
+
+	if viewCh, err := s.backend.WatchViewConfig(); err != nil {
+		log.Warn("failed to watch view config", log.Fields{"node": s.address, "error": err.Error()})
+	} else {
+		go func() {
+			for cfg := range viewCh {
+				if len(cfg.Replicas) == 0 {
+					continue
+				}
+				log.Info("view config updated via coordination backend",
+					log.Fields{"node": s.address, "replicas": cfg.Replicas})
+				s.hash.Set(cfg.Replicas)
+				s.store.SetReplicas(cfg.Replicas)
+			}
+		}()
+	}
+
+	if membersCh, err := s.backend.WatchMembers(); err != nil {
+		log.Warn("failed to watch members", log.Fields{"node": s.address, "error": err.Error()})
+	} else {
+		go func() {
+			for members := range membersCh {
+				s.membersMu.Lock()
+				s.members = members
+				s.membersMu.Unlock()
+
+				if s.IsLeader() {
+					// Membership changed (e.g. a node just RegisterNode'd
+					// itself) while we hold the lease: republish the view so
+					// the new member actually reaches every node's hash ring
+					// instead of waiting for some other trigger that may
+					// never come.
+					log.Info("membership changed, publishing view config",
+						log.Fields{"node": s.address, "replicas": members})
+					if err := s.backend.PutViewConfig(coord.ViewConfig{Replicas: members}); err != nil {
+						log.Warn("failed to publish view config", log.Fields{"node": s.address, "error": err.Error()})
+					}
+				}
+			}
+		}()
+	}
+
+	leaderCh, err := s.backend.AcquireLeaderLease(s.address, CLIENT_TIMEOUT*3)
+	if err != nil {
+		log.Warn("failed to start leader election", log.Fields{"node": s.address, "error": err.Error()})
+		return
+	}
+	go func() {
+		for isLeader := range leaderCh {
+			s.setIsLeader(isLeader)
+			if isLeader {
+				// Take over the role the manual /kv-store/view-change
+				// fan-out used to play: the lease holder publishes the
+				// membership so every other node picks it up through its own
+				// WatchViewConfig. Prefer the backend's own membership view
+				// (kept current by the WatchMembers goroutine above) over
+				// this node's boot-time hash ring, which never learns about
+				// a node that registered after this node started.
+				replicas := s.currentMembers()
+				if replicas == nil {
+					replicas = s.hash.Members()
+				}
+				cfg := coord.ViewConfig{Replicas: replicas}
+				if err := s.backend.PutViewConfig(cfg); err != nil {
+					log.Warn("failed to publish view config", log.Fields{"node": s.address, "error": err.Error()})
+				}
+			}
+		}
+	}()
+}
+
 func (s *State) Route(r *mux.Router) {
 	r.HandleFunc("/kv-store/keys/{key:.*}", s.forwardMessage).MatcherFunc(s.shouldForward)
-	r.HandleFunc("/kv-store/view-change", types.WrapHTTP(s.viewChange)).Methods(http.MethodPut)
+	r.HandleFunc("/kv-store/counters/{key:.*}", s.forwardMessage).MatcherFunc(s.shouldForward)
+	if s.backend == nil {
+		// With a coordination backend configured, WatchViewConfig above
+		// replaces this manual fan-out entirely; keep it only for the
+		// static-membership case that has no backend to publish through.
+		r.HandleFunc("/kv-store/view-change", types.WrapHTTP(s.viewChange)).Methods(http.MethodPut)
+	}
+	r.HandleFunc("/admin/mode", s.modeHandler).Methods(http.MethodPut, http.MethodGet)
+
+	s.raft.Route(r)
 
-	r.HandleFunc("/kv-store/keys/{key:.*}", types.WrapHTTP(types.ValidateKey(s.putHandler))).Methods(http.MethodPut)
-	r.HandleFunc("/kv-store/keys/{key:.*}", types.WrapHTTP(types.ValidateKey(s.deleteHandler))).Methods(http.MethodDelete)
+	r.HandleFunc("/kv-store/keys/{key:.*}", s.withContext(s.putHandler)).Methods(http.MethodPut)
+	r.HandleFunc("/kv-store/keys/{key:.*}", s.withContext(s.deleteHandler)).Methods(http.MethodDelete)
 	r.HandleFunc("/kv-store/keys/{key:.*}", types.WrapHTTP(types.ValidateKey(s.getHandler))).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/counters/{key:.*}", s.withContext(s.incrementHandler)).Methods(http.MethodPut)
+}
+
+// modeHandler lets an operator inspect or switch a node's consistency mode at
+// runtime, e.g. to bring a freshly joined node up in raft.ModeStandby before
+// promoting it to a full voting member.
+func (s *State) modeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string]string{"mode": s.raft.Mode().String()})
+		return
+	}
+
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, msg.FailedToParse, http.StatusBadRequest)
+		return
+	}
+
+	var mode raft.Mode
+	switch body.Mode {
+	case "causal":
+		mode = raft.ModeCausal
+	case "linearizable":
+		mode = raft.ModeLinearizable
+	case "standby":
+		mode = raft.ModeStandby
+	default:
+		http.Error(w, "unknown mode "+body.Mode, http.StatusBadRequest)
+		return
+	}
+
+	s.raft.SetMode(mode)
+	json.NewEncoder(w).Encode(map[string]string{"mode": mode.String()})
 }
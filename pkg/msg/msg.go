@@ -17,4 +17,6 @@ const (
 	KeyDNE        = "Key does not exist"
 	KeyTooLong    = "Key is too long"
 	ValueMissing  = "Value is missing"
+
+	BadCounterDelta = "Value must be an integer counter delta"
 )
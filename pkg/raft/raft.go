@@ -0,0 +1,727 @@
+// Package raft wraps a store.Store behind a replicated log, giving callers a
+// choice between the existing causal-consistency gossip path and a
+// linearizable path backed by leader election, heartbeats and log
+// replication (in the spirit of etcd's participant/standby server modes).
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/cse138/pkg/clock"
+	"github.com/spencer-p/cse138/pkg/log"
+	"github.com/spencer-p/cse138/pkg/store"
+	"github.com/spencer-p/cse138/pkg/util"
+
+	"github.com/gorilla/mux"
+)
+
+// Mode selects how writes reach the local store.
+type Mode int
+
+const (
+	// ModeCausal is the default: writes are applied locally and propagated by
+	// gossip, ordered only by vector clock.
+	ModeCausal Mode = iota
+	// ModeLinearizable routes writes through the raft log and only applies
+	// them once a majority of voting peers have acknowledged the entry.
+	ModeLinearizable
+	// ModeStandby receives the replicated log like a linearizable node but
+	// does not vote in elections. It exists to let a node warm up (e.g.
+	// during view expansion) before it counts toward quorum.
+	ModeStandby
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeCausal:
+		return "causal"
+	case ModeLinearizable:
+		return "linearizable"
+	case ModeStandby:
+		return "standby"
+	default:
+		return "unknown"
+	}
+}
+
+// Op identifies what a LogEntry does to the store.
+type Op int
+
+const (
+	OpWrite Op = iota
+	OpDelete
+	OpViewChange
+)
+
+// LogEntry is a single proposal in the replicated log.
+type LogEntry struct {
+	Term  int
+	Index int
+
+	Op    Op
+	Key   string
+	Value string
+	Clock clock.VectorClock
+
+	// Replicas is only set for OpViewChange entries.
+	Replicas []string
+}
+
+const (
+	heartbeatInterval   = 50 * time.Millisecond
+	electionTimeoutBase = 300 * time.Millisecond
+	electionTimeoutFuzz = 200 * time.Millisecond
+)
+
+var (
+	ErrNotLeader = errors.New("raft: this node is not the leader")
+	ErrNoQuorum  = errors.New("raft: failed to reach quorum for proposal")
+)
+
+type role int
+
+const (
+	roleFollower role = iota
+	roleCandidate
+	roleLeader
+)
+
+// Node runs the raft protocol for a single replica and applies committed
+// entries to the wrapped store.Store.
+type Node struct {
+	address string
+	store   *store.Store
+	client  *http.Client
+
+	m        sync.Mutex
+	mode     Mode
+	peers    []string
+	role     role
+	term     int
+	votedFor string
+	leaderID string
+	log      []LogEntry
+	commit   int // number of log entries known committed
+	applied  int // number of committed entries applied to the store so far
+
+	resetElection chan struct{}
+}
+
+// NewNode constructs a raft node for the local store. view is the full
+// cluster membership including this node's own address; NewNode strips it so
+// that Propose and startElection only ever RPC other nodes. The node starts
+// in ModeCausal and must be switched to ModeLinearizable (or ModeStandby) via
+// SetMode before it takes part in elections.
+func NewNode(address string, view []string, s *store.Store) *Node {
+	return &Node{
+		address:       address,
+		store:         s,
+		client:        &http.Client{Timeout: heartbeatInterval * 4},
+		mode:          ModeCausal,
+		peers:         otherPeers(view, address),
+		role:          roleFollower,
+		resetElection: make(chan struct{}, 1),
+	}
+}
+
+// otherPeers returns view with self removed, so callers that RPC every
+// element of peers never RPC themselves.
+func otherPeers(view []string, self string) []string {
+	peers := make([]string, 0, len(view))
+	for _, addr := range view {
+		if addr != self {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// Mode returns the node's current consistency mode.
+func (n *Node) Mode() Mode {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.mode
+}
+
+// LeaderID returns the address of the node this node most recently heard is
+// leader (including itself, if it is the leader), or "" if no leader has
+// been observed yet. Callers whose Propose returns ErrNotLeader can use it to
+// redirect the caller to the current leader instead of simply failing.
+func (n *Node) LeaderID() string {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.leaderID
+}
+
+// SetMode switches the node's consistency mode at runtime. Switching into
+// ModeLinearizable (re)starts the election timer; switching out of it leaves
+// the node a passive follower that only applies entries it is sent.
+func (n *Node) SetMode(mode Mode) {
+	n.m.Lock()
+	wasActive := n.mode == ModeLinearizable || n.mode == ModeStandby
+	n.mode = mode
+	becomesActive := mode == ModeLinearizable || mode == ModeStandby
+	n.m.Unlock()
+
+	log.Info("switching raft mode", log.Fields{"node": n.address, "mode": mode.String()})
+
+	if becomesActive && !wasActive {
+		go n.runElectionTimer()
+	}
+}
+
+// Propose appends an entry to the leader's log, sends it to every peer and
+// blocks until each has answered. If a majority (counting the leader) accepted
+// it, the entry is committed and applied to the leader's store; followers
+// apply it once a later AppendEntries or heartbeat carries the new commit
+// index. Otherwise it returns ErrNoQuorum. It returns ErrNotLeader if called
+// on a non-leader node, in which case the caller (handlers.State) can
+// redirect to the leader (see LeaderID).
+func (n *Node) Propose(ctx context.Context, op Op, key, value string) error {
+	n.m.Lock()
+	if n.role != roleLeader {
+		n.m.Unlock()
+		return ErrNotLeader
+	}
+
+	entry := LogEntry{
+		Term:  n.term,
+		Index: len(n.log),
+		Op:    op,
+		Key:   key,
+		Value: value,
+	}
+	n.log = append(n.log, entry)
+	peers := append([]string(nil), n.peers...)
+	n.m.Unlock()
+
+	acks := 1 // the leader counts as a vote for its own entry
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(len(peers))
+	for _, p := range peers {
+		p := p
+		go func() {
+			defer wg.Done()
+			if n.sendAppendEntries(p, entry) {
+				mu.Lock()
+				acks++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acks*2 <= len(peers)+1 {
+		return ErrNoQuorum
+	}
+
+	n.m.Lock()
+	if entry.Index+1 > n.commit {
+		n.commit = entry.Index + 1
+	}
+	n.m.Unlock()
+
+	n.applyCommitted(ctx)
+	return nil
+}
+
+// applyCommitted applies every log entry between the last entry this node
+// applied and the current commit index, in order. Followers must not apply
+// an entry the moment handleAppendEntries appends it to the log: until the
+// leader reports it committed, a concurrent leader in a higher term could
+// still overwrite it, so applying early can let an uncommitted write reach
+// the store.
+func (n *Node) applyCommitted(ctx context.Context) {
+	n.m.Lock()
+	var pending []LogEntry
+	for n.applied < n.commit {
+		pending = append(pending, n.log[n.applied])
+		n.applied++
+	}
+	n.m.Unlock()
+
+	for _, e := range pending {
+		n.apply(ctx, e)
+	}
+}
+
+// apply installs a committed entry into the wrapped store.
+func (n *Node) apply(ctx context.Context, e LogEntry) {
+	switch e.Op {
+	case OpWrite:
+		n.store.ApplyReplicated(ctx, store.Entry{Key: e.Key, Value: e.Value})
+	case OpDelete:
+		n.store.ApplyReplicated(ctx, store.Entry{Key: e.Key, Deleted: true})
+	case OpViewChange:
+		n.store.SetReplicas(e.Replicas)
+		n.m.Lock()
+		n.peers = otherPeers(e.Replicas, n.address)
+		n.m.Unlock()
+	}
+}
+
+// AppendEntriesArgs is sent by the leader to replicate (or heartbeat) a
+// single log entry.
+type AppendEntriesArgs struct {
+	Term     int
+	LeaderID string
+	Entry    *LogEntry // nil for a pure heartbeat
+
+	// PrevLogIndex/PrevLogTerm identify the entry immediately before Entry in
+	// the leader's log. A follower only accepts Entry if it has exactly this
+	// entry at PrevLogIndex (Raft's log-matching property); otherwise its log
+	// has diverged from the leader's and it must reject the append rather
+	// than blindly appending, which would let a duplicated or out-of-order
+	// RPC corrupt the log positions apply() later reads entries from.
+	PrevLogIndex int
+	PrevLogTerm  int
+
+	// LeaderCommit is the number of log entries the leader has committed so
+	// far. A follower advances its own commit index to min(LeaderCommit,
+	// len(log)) and applies any newly-committed entries; it never applies an
+	// entry before the leader reports it committed.
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+}
+
+func (n *Node) sendAppendEntries(peer string, entry LogEntry) bool {
+	args := AppendEntriesArgs{LeaderID: n.address, Entry: &entry}
+	n.m.Lock()
+	args.Term = n.term
+	args.LeaderCommit = n.commit
+	args.PrevLogIndex = entry.Index - 1
+	if args.PrevLogIndex >= 0 && args.PrevLogIndex < len(n.log) {
+		args.PrevLogTerm = n.log[args.PrevLogIndex].Term
+	}
+	n.m.Unlock()
+
+	var reply AppendEntriesReply
+	if err := n.call(peer, "/raft/append-entries", args, &reply); err != nil {
+		log.Warn("append-entries failed", log.Fields{"node": n.address, "peer": peer, "error": err.Error()})
+		return false
+	}
+
+	if !reply.Success && reply.Term <= args.Term {
+		// The peer is current enough to have an opinion but rejected us on
+		// log-matching grounds, meaning it is missing entries this node never
+		// resends on its own (Propose only ever sends an entry once). Install
+		// a full snapshot so the peer catches up wholesale instead of staying
+		// permanently behind.
+		n.installSnapshot(peer)
+	}
+	return reply.Success
+}
+
+// InstallSnapshotArgs carries a full copy of the leader's store so a follower
+// that has fallen behind the leader's log (see sendAppendEntries) can catch
+// up in one RPC instead of one log entry at a time.
+type InstallSnapshotArgs struct {
+	Term     int
+	LeaderID string
+
+	// LastIncludedIndex/LastIncludedTerm are the index and term of the last
+	// log entry reflected in Snapshot. The follower adopts them as the start
+	// of its own log, so future AppendEntries can still log-match against
+	// them without the leader ever resending the compacted entries.
+	LastIncludedIndex int
+	LastIncludedTerm  int
+
+	Snapshot store.Snapshot
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// installSnapshot sends this leader's entire store to peer, catching it up
+// in one RPC. It is only a best-effort nudge: sendAppendEntries will retry it
+// on the next proposal if the RPC fails, so errors are logged, not returned.
+func (n *Node) installSnapshot(peer string) {
+	n.m.Lock()
+	lastIndex := len(n.log) - 1
+	lastTerm := 0
+	if lastIndex >= 0 {
+		lastTerm = n.log[lastIndex].Term
+	}
+	args := InstallSnapshotArgs{
+		Term:              n.term,
+		LeaderID:          n.address,
+		LastIncludedIndex: lastIndex,
+		LastIncludedTerm:  lastTerm,
+		Snapshot:          n.store.Snapshot(),
+	}
+	n.m.Unlock()
+
+	var reply InstallSnapshotReply
+	if err := n.call(peer, "/raft/install-snapshot", args, &reply); err != nil {
+		log.Warn("install-snapshot failed", log.Fields{"node": n.address, "peer": peer, "error": err.Error()})
+	}
+}
+
+// RequestVoteArgs is sent by a candidate soliciting votes. LastIndex/LastTerm
+// describe the candidate's log so voters can refuse a candidate whose log is
+// behind their own (Raft §5.4.1): granting a vote to a node missing
+// committed entries would let it win an election and then overwrite them.
+type RequestVoteArgs struct {
+	Term        int
+	CandidateID string
+	LastIndex   int
+	LastTerm    int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+func (n *Node) call(peer, route string, body, reply interface{}) error {
+	target, err := url.Parse(util.CorrectURL(peer))
+	if err != nil {
+		return fmt.Errorf("bad peer address %q: %v", peer, err)
+	}
+	target.Path = path.Join(target.Path, route)
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// Route registers the HTTP endpoints raft peers use to reach this node.
+func (n *Node) Route(r *mux.Router) {
+	r.HandleFunc("/raft/append-entries", n.handleAppendEntries).Methods(http.MethodPost)
+	r.HandleFunc("/raft/request-vote", n.handleRequestVote).Methods(http.MethodPost)
+	r.HandleFunc("/raft/install-snapshot", n.handleInstallSnapshot).Methods(http.MethodPost)
+}
+
+func (n *Node) handleAppendEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+
+	var args AppendEntriesArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	n.m.Lock()
+	reply := AppendEntriesReply{Term: n.term}
+	if args.Term < n.term {
+		n.m.Unlock()
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	n.term = args.Term
+	n.role = roleFollower
+	n.leaderID = args.LeaderID
+
+	success := true
+	if args.Entry != nil {
+		success = n.appendEntry(args)
+	}
+	if success && args.LeaderCommit > n.commit {
+		if n.commit = args.LeaderCommit; n.commit > len(n.log) {
+			n.commit = len(n.log)
+		}
+	}
+	n.m.Unlock()
+
+	// Any append from a leader we recognize as current or newer means a
+	// leader exists, whether or not its entry matched our log - reset the
+	// timer either way so a log mismatch alone can't spin up an election.
+	select {
+	case n.resetElection <- struct{}{}:
+	default:
+	}
+
+	if success {
+		n.applyCommitted(ctx)
+	}
+
+	reply.Success = success
+	json.NewEncoder(w).Encode(reply)
+}
+
+// appendEntry enforces Raft's log-matching property before splicing
+// args.Entry into the log: it only accepts the entry if this follower's log
+// already holds exactly args.PrevLogIndex/args.PrevLogTerm, so a duplicated
+// or out-of-order AppendEntries can never silently diverge this follower's
+// log from the leader's. Callers must hold n.m.
+func (n *Node) appendEntry(args AppendEntriesArgs) bool {
+	if args.PrevLogIndex >= 0 {
+		if args.PrevLogIndex >= len(n.log) || n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+			return false
+		}
+	}
+
+	switch {
+	case args.Entry.Index < len(n.log):
+		// A retry of an entry we already have (or a stale leader's entry at
+		// this index): overwrite it and drop anything that followed, so the
+		// log exactly matches the leader's from here on.
+		n.log = append(n.log[:args.Entry.Index], *args.Entry)
+	case args.Entry.Index == len(n.log):
+		n.log = append(n.log, *args.Entry)
+	default:
+		// A gap: this follower is missing entries the leader assumes it has.
+		return false
+	}
+	return true
+}
+
+// handleInstallSnapshot replaces this node's entire store with the leader's,
+// then rewinds the log to a single sentinel entry at LastIncludedIndex so
+// later AppendEntries can still log-match against it without the leader ever
+// resending the entries the snapshot compacted away.
+func (n *Node) handleInstallSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+
+	var args InstallSnapshotArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	n.m.Lock()
+	if args.Term < n.term {
+		reply := InstallSnapshotReply{Term: n.term}
+		n.m.Unlock()
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	n.term = args.Term
+	n.role = roleFollower
+	n.leaderID = args.LeaderID
+
+	n.log = make([]LogEntry, args.LastIncludedIndex+1)
+	if args.LastIncludedIndex >= 0 {
+		n.log[args.LastIncludedIndex] = LogEntry{Term: args.LastIncludedTerm, Index: args.LastIncludedIndex}
+	}
+	n.commit = args.LastIncludedIndex + 1
+	n.applied = args.LastIncludedIndex + 1
+	n.m.Unlock()
+
+	n.store.Restore(ctx, args.Snapshot)
+
+	select {
+	case n.resetElection <- struct{}{}:
+	default:
+	}
+
+	json.NewEncoder(w).Encode(InstallSnapshotReply{Term: args.Term})
+}
+
+func (n *Node) handleRequestVote(w http.ResponseWriter, r *http.Request) {
+	var args RequestVoteArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	reply := RequestVoteReply{Term: n.term}
+
+	// A standby node is warming up: it never grants a vote and never stands
+	// for election. Other nodes do not know it is standby, so it still counts
+	// in the cluster size their majorities are computed over, and its
+	// AppendEntries acks count toward a proposal's majority.
+	if n.mode == ModeStandby {
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	if args.Term < n.term || (n.votedFor != "" && n.votedFor != args.CandidateID) {
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	myLastIndex := len(n.log) - 1
+	myLastTerm := 0
+	if myLastIndex >= 0 {
+		myLastTerm = n.log[myLastIndex].Term
+	}
+	if args.LastTerm < myLastTerm || (args.LastTerm == myLastTerm && args.LastIndex < myLastIndex) {
+		// The candidate's log is missing entries we have; granting it the
+		// vote could let it win and then overwrite them once leader.
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	n.term = args.Term
+	n.votedFor = args.CandidateID
+	reply.VoteGranted = true
+	json.NewEncoder(w).Encode(reply)
+
+	select {
+	case n.resetElection <- struct{}{}:
+	default:
+	}
+}
+
+// runElectionTimer waits for either a heartbeat/append-entries reset or an
+// election timeout, and starts an election in the latter case. Standby nodes
+// never stand for election themselves but still reset on leader contact so
+// they stop waiting once a leader emerges. Once the node is switched to
+// ModeCausal the timer steps it down to follower and exits.
+func (n *Node) runElectionTimer() {
+	for {
+		if n.Mode() == ModeCausal {
+			n.m.Lock()
+			n.role = roleFollower // also ends runHeartbeats
+			n.m.Unlock()
+			return
+		}
+		timeout := electionTimeoutBase + time.Duration(rand.Int63n(int64(electionTimeoutFuzz)))
+		select {
+		case <-n.resetElection:
+			continue
+		case <-time.After(timeout):
+			if n.Mode() != ModeLinearizable {
+				continue
+			}
+			n.m.Lock()
+			isLeader := n.role == roleLeader
+			n.m.Unlock()
+			if isLeader {
+				// A leader's own election timer never gets reset (it is the
+				// one sending AppendEntries, not receiving them); heartbeats
+				// are what keep it leader, so just wait for the next timeout
+				// instead of spuriously challenging itself.
+				continue
+			}
+			n.startElection()
+		}
+	}
+}
+
+func (n *Node) startElection() {
+	n.m.Lock()
+	n.role = roleCandidate
+	n.term++
+	n.votedFor = n.address
+	term := n.term
+	lastIndex := len(n.log) - 1
+	lastTerm := 0
+	if lastIndex >= 0 {
+		lastTerm = n.log[lastIndex].Term
+	}
+	peers := append([]string(nil), n.peers...)
+	n.m.Unlock()
+
+	votes := 1
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for _, p := range peers {
+		p := p
+		go func() {
+			defer wg.Done()
+			var reply RequestVoteReply
+			err := n.call(p, "/raft/request-vote", RequestVoteArgs{
+				Term:        term,
+				CandidateID: n.address,
+				LastIndex:   lastIndex,
+				LastTerm:    lastTerm,
+			}, &reply)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if reply.VoteGranted {
+				votes++
+			}
+		}()
+	}
+	wg.Wait()
+
+	n.m.Lock()
+	if n.term != term || n.role != roleCandidate {
+		n.m.Unlock()
+		return // someone else became leader or our term moved on while we waited
+	}
+	won := votes*2 > len(peers)+1
+	if won {
+		n.role = roleLeader
+		n.leaderID = n.address
+	}
+	n.m.Unlock()
+
+	if won {
+		log.Info("elected leader", log.Fields{"node": n.address, "term": term})
+		go n.runHeartbeats(term)
+	}
+}
+
+// runHeartbeats sends empty AppendEntries to every peer on heartbeatInterval
+// for as long as this node remains leader of term, resetting followers'
+// election timers so a stable leader is never voted out from under itself.
+func (n *Node) runHeartbeats(term int) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n.m.Lock()
+		if n.role != roleLeader || n.term != term {
+			n.m.Unlock()
+			return
+		}
+		peers := append([]string(nil), n.peers...)
+		commit := n.commit
+		n.m.Unlock()
+
+		args := AppendEntriesArgs{Term: term, LeaderID: n.address, LeaderCommit: commit}
+		for _, p := range peers {
+			p := p
+			go func() {
+				var reply AppendEntriesReply
+				if err := n.call(p, "/raft/append-entries", args, &reply); err != nil {
+					log.Warn("heartbeat failed", log.Fields{"node": n.address, "peer": p, "error": err.Error()})
+				}
+			}()
+		}
+	}
+}
+
+// requestContext builds a context carrying r's X-Request-ID header (or a
+// freshly generated one), so log lines emitted while handling this RPC can
+// be correlated with the client request that triggered it.
+func requestContext(r *http.Request) context.Context {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = log.NewRequestID()
+	}
+	return log.WithRequestID(r.Context(), id)
+}
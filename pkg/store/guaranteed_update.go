@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+
+	"github.com/spencer-p/cse138/pkg/clock"
+)
+
+// GuaranteedUpdate performs an optimistic read/mutate/write loop on a single
+// key, modeled on Kubernetes' etcd3 storage GuaranteedUpdate. tryUpdate is
+// handed the current entry (the zero Entry if the key does not exist) and
+// returns the entry to commit in its place. Unlike Write, which always
+// overwrites regardless of what changed underneath it, GuaranteedUpdate
+// notices if another writer committed a newer version of key while
+// tryUpdate was running and re-invokes tryUpdate against the fresh state
+// instead of clobbering it or blocking forever in waitUntilCurrent.
+//
+// This gives handler code a race-free primitive for compare-and-swap-style
+// operations (incrementing a counter, appending to a list) without
+// reimplementing the read/mutate/write loop and vector-clock plumbing at
+// every call site.
+func (s *Store) GuaranteedUpdate(ctx context.Context, tcausal clock.VectorClock, key string, tryUpdate func(current Entry) (Entry, error)) (
+	err error,
+	result Entry,
+	currentClock clock.VectorClock) {
+
+	// origStateIsCurrent tracks whether `current` still reflects the store's
+	// state, so a retry (caused by a lost race, not a stale read) does not
+	// re-fetch something we already know is fresh.
+	origStateIsCurrent := false
+	var current Entry
+
+	for {
+		s.m.Lock()
+		if err = s.waitUntilCurrent(tcausal); err != nil {
+			s.m.Unlock()
+			return
+		}
+		if !origStateIsCurrent {
+			current = s.store[key]
+		}
+		s.m.Unlock()
+
+		updated, uerr := tryUpdate(current)
+		if uerr != nil {
+			err = uerr
+			s.m.Lock()
+			s.copyClock(&currentClock)
+			s.m.Unlock()
+			return
+		}
+
+		s.m.Lock()
+		latest := s.store[key]
+		if !entriesEqual(latest, current) {
+			// Someone committed a newer version of key while tryUpdate was
+			// running. Retry against the fresh state rather than clobbering
+			// it or giving up.
+			current = latest
+			origStateIsCurrent = true
+			s.m.Unlock()
+			continue
+		}
+
+		s.vc.Max(tcausal)
+		updated.Key = key
+		s.commitWrite(ctx, updated, true)
+		result = updated
+		s.copyClock(&currentClock)
+		s.m.Unlock()
+		return
+	}
+}
+
+// entriesEqual reports whether a and b are the same version of a key, i.e.
+// GuaranteedUpdate's cached read is still the store's current value.
+func entriesEqual(a, b Entry) bool {
+	return a.Key == b.Key &&
+		a.Value == b.Value &&
+		a.Deleted == b.Deleted &&
+		a.Clock.Compare(b.Clock) == clock.Equal
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// numBuckets partitions the keyspace for Merkle anti-entropy. A fixed power
+// of two keeps the tree perfectly balanced and lets a node's path be read
+// directly off the bucket index's bits.
+const numBuckets = 1024
+
+// merkleTree is a binary hash tree over numBuckets leaf buckets, stored as a
+// flat array using classic segment-tree indexing: leaves live at
+// [numBuckets, 2*numBuckets), node i's children are at 2i and 2i+1, and the
+// root is at index 1. Rebuilding a leaf costs O(bucket size) instead of
+// O(N); walking back to the root costs O(log numBuckets). This lets
+// commitWrite keep the tree current without rehashing the whole store.
+type merkleTree struct {
+	nodes [2 * numBuckets][]byte
+	keys  [numBuckets]map[string]struct{}
+}
+
+func newMerkleTree() *merkleTree {
+	t := &merkleTree{}
+	for i := range t.keys {
+		t.keys[i] = make(map[string]struct{})
+	}
+
+	empty := sha256.Sum256(nil)
+	for i := numBuckets; i < 2*numBuckets; i++ {
+		t.nodes[i] = empty[:]
+	}
+	for i := numBuckets - 1; i >= 1; i-- {
+		t.nodes[i] = hashPair(t.nodes[2*i], t.nodes[2*i+1])
+	}
+	return t
+}
+
+// bucketOf deterministically maps a key to one of numBuckets leaves.
+func bucketOf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint64(sum[:8]) % numBuckets)
+}
+
+func hashPair(a, b []byte) []byte {
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// update recomputes the leaf and ancestor hashes affected by a write to key.
+// It expects to be called with s.store already holding e (commitWrite writes
+// the map and calls update while still holding the store's lock).
+func (t *merkleTree) update(key string, e Entry, store map[string]Entry) {
+	bucket := bucketOf(key)
+	t.keys[bucket][key] = struct{}{}
+
+	h := sha256.New()
+	ordered := make([]string, 0, len(t.keys[bucket]))
+	for k := range t.keys[bucket] {
+		ordered = append(ordered, k)
+	}
+	sort.Strings(ordered)
+	for _, k := range ordered {
+		entry := store[k]
+		fmt.Fprintf(h, "%s\x00%s\x00%v\x00%v\x00", entry.Key, entry.Value, entry.Deleted, entry.Clock)
+	}
+
+	leaf := numBuckets + bucket
+	t.nodes[leaf] = h.Sum(nil)
+	for i := leaf / 2; i >= 1; i /= 2 {
+		t.nodes[i] = hashPair(t.nodes[2*i], t.nodes[2*i+1])
+	}
+}
+
+func (t *merkleTree) root() []byte {
+	return t.nodes[1]
+}
+
+// bucketForPath converts a full-depth 'L'/'R' leaf path (see node) back into
+// the bucket index BucketEntries expects, for a caller that has descended
+// the tree to a mismatched leaf and now needs to fetch that bucket's data.
+func bucketForPath(path string) (int, error) {
+	idx := 1
+	for _, c := range path {
+		idx *= 2
+		switch c {
+		case 'L':
+			// left child, no offset
+		case 'R':
+			idx++
+		default:
+			return 0, errors.New("merkle: path must contain only 'L' and 'R'")
+		}
+	}
+	if idx < numBuckets || idx >= 2*numBuckets {
+		return 0, fmt.Errorf("merkle: path %q is not a full-depth leaf path", path)
+	}
+	return idx - numBuckets, nil
+}
+
+// node resolves a path of 'L'/'R' turns from the root to a tree index and
+// returns its hash.
+func (t *merkleTree) node(path string) ([]byte, error) {
+	idx := 1
+	for _, c := range path {
+		idx *= 2
+		switch c {
+		case 'L':
+			// left child, no offset
+		case 'R':
+			idx++
+		default:
+			return nil, errors.New("merkle: path must contain only 'L' and 'R'")
+		}
+		if idx >= 2*numBuckets {
+			return nil, fmt.Errorf("merkle: path %q descends past the leaves", path)
+		}
+	}
+	return t.nodes[idx], nil
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// newTestStore builds a Store with no journal consumer, suitable for tests
+// that only go through ApplyReplicated (which never journals).
+func newTestStore(addr string) *Store {
+	return New(addr, []string{addr}, nil)
+}
+
+// pathTo converts a bucket index into the 'L'/'R' path merkleTree.node
+// expects, i.e. the bucket's index written out as binary with 'L' for 0 and
+// 'R' for 1, most significant bit first.
+func pathTo(bucket int) string {
+	bitsLen := 0
+	for n := numBuckets; n > 1; n >>= 1 {
+		bitsLen++
+	}
+
+	path := make([]byte, bitsLen)
+	for i := bitsLen - 1; i >= 0; i-- {
+		if bucket&1 == 1 {
+			path[i] = 'R'
+		} else {
+			path[i] = 'L'
+		}
+		bucket >>= 1
+	}
+	return string(path)
+}
+
+func TestMerkleRootEqualForIdenticalData(t *testing.T) {
+	a := newTestStore("a")
+	b := newTestStore("b")
+
+	entries := []Entry{
+		{Key: "alpha", Value: "1"},
+		{Key: "beta", Value: "2"},
+		{Key: "gamma", Value: "3"},
+	}
+	for _, e := range entries {
+		a.ApplyReplicated(context.Background(), e)
+		b.ApplyReplicated(context.Background(), e)
+	}
+
+	if !bytes.Equal(a.MerkleRoot(), b.MerkleRoot()) {
+		t.Fatalf("expected equal roots for identical data, got %x vs %x", a.MerkleRoot(), b.MerkleRoot())
+	}
+}
+
+func TestMerkleRootDivergenceIsLocalizedToOneBucket(t *testing.T) {
+	a := newTestStore("a")
+	b := newTestStore("b")
+
+	shared := []Entry{
+		{Key: "alpha", Value: "1"},
+		{Key: "beta", Value: "2"},
+		{Key: "gamma", Value: "3"},
+	}
+	for _, e := range shared {
+		a.ApplyReplicated(context.Background(), e)
+		b.ApplyReplicated(context.Background(), e)
+	}
+
+	// Diverge a single key on b only.
+	a.ApplyReplicated(context.Background(), Entry{Key: "gamma", Value: "3"})
+	b.ApplyReplicated(context.Background(), Entry{Key: "gamma", Value: "different"})
+
+	if bytes.Equal(a.MerkleRoot(), b.MerkleRoot()) {
+		t.Fatalf("expected roots to diverge after a differing write")
+	}
+
+	diverged := bucketOf("gamma")
+	for bucket := 0; bucket < numBuckets; bucket++ {
+		path := pathTo(bucket)
+		aLeaf, err := a.MerkleNode(path)
+		if err != nil {
+			t.Fatalf("a.MerkleNode(%q): %v", path, err)
+		}
+		bLeaf, err := b.MerkleNode(path)
+		if err != nil {
+			t.Fatalf("b.MerkleNode(%q): %v", path, err)
+		}
+
+		equal := bytes.Equal(aLeaf, bLeaf)
+		if bucket == diverged {
+			if equal {
+				t.Fatalf("bucket %d holds the differing key but its leaf hash matches", bucket)
+			}
+		} else if !equal {
+			t.Fatalf("bucket %d has identical data on both stores but its leaf hash differs", bucket)
+		}
+	}
+}
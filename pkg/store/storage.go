@@ -1,12 +1,14 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/spencer-p/cse138/pkg/clock"
+	"github.com/spencer-p/cse138/pkg/log"
 )
 
 var (
@@ -37,6 +39,8 @@ type Store struct {
 	vc       clock.VectorClock
 	vcCond   *sync.Cond
 	journal  chan<- Entry
+
+	merkle *merkleTree
 }
 
 // New constructs an empty store that resides at the given address or unique ID.
@@ -51,16 +55,19 @@ func New(selfAddr string, replicas []string, callback chan<- Entry) *Store {
 		vc:       clock.VectorClock{},
 		vcCond:   sync.NewCond(&mtx),
 		journal:  callback,
+		merkle:   newMerkleTree(),
 	}
 }
 
 // Write performs a new write to the store. It will block until the write can be applied
 // according to the vector clock passed.
-func (s *Store) Write(tcausal clock.VectorClock, key, value string) (
+func (s *Store) Write(ctx context.Context, tcausal clock.VectorClock, key, value string) (
 	err error,
 	replaced bool,
 	currentClock clock.VectorClock) {
 
+	start := time.Now()
+
 	// Acquire access to the store
 	s.m.Lock()
 	defer s.m.Unlock()
@@ -75,35 +82,40 @@ func (s *Store) Write(tcausal clock.VectorClock, key, value string) (
 
 	// Perform the write
 	s.vc.Max(tcausal)
-	replaced = s.commitWrite(Entry{
+	replaced = s.commitWrite(ctx, Entry{
 		Key:     key,
 		Value:   value,
 		Deleted: false,
 	}, true)
+
+	log.Debug("write", log.FromContext(ctx, log.Fields{
+		"node": s.addr, "key": key, "op": "write", "latency_ms": time.Since(start).Milliseconds(),
+	}))
 	return
 }
 
 // ImportEntry imports an existing entry from another store.
-func (s *Store) ImportEntry(e Entry) error {
+func (s *Store) ImportEntry(ctx context.Context, e Entry) error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
 	if err := s.waitForGossip(e.Clock); err != nil {
 		return err
 	}
-	s.Store[key].Vec.Increment(address)
 
 	s.vc.Max(e.Clock)
-	s.commitWrite(e, false)
+	s.commitWrite(ctx, e, false)
 
 	return nil
 }
 
 // Delete deletes a key, returning true if it was deleted.
-func (s *Store) Delete(tcausal clock.VectorClock, key string) (
+func (s *Store) Delete(ctx context.Context, tcausal clock.VectorClock, key string) (
 	err error,
 	deleted bool,
 	currentClock clock.VectorClock) {
+	start := time.Now()
+
 	s.m.Lock()
 	defer s.m.Unlock()
 	defer s.copyClock(&currentClock)
@@ -119,11 +131,15 @@ func (s *Store) Delete(tcausal clock.VectorClock, key string) (
 
 	// Perform the delete if we have the object
 	s.vc.Max(tcausal)
-	deleted = s.commitWrite(Entry{Key: key, Deleted: true}, true)
+	deleted = s.commitWrite(ctx, Entry{Key: key, Deleted: true}, true)
+
+	log.Debug("delete", log.FromContext(ctx, log.Fields{
+		"node": s.addr, "key": key, "op": "delete", "latency_ms": time.Since(start).Milliseconds(),
+	}))
 	return
 }
 
-func (s *Store) commitWrite(e Entry, shouldJournal bool) (replaced bool) {
+func (s *Store) commitWrite(ctx context.Context, e Entry, shouldJournal bool) (replaced bool) {
 	// Check if the entry previously existed
 	oldentry, exists := s.store[e.Key]
 	replaced = exists && oldentry.Deleted != true
@@ -137,10 +153,14 @@ func (s *Store) commitWrite(e Entry, shouldJournal bool) (replaced bool) {
 
 	// Perform the write
 	s.store[e.Key] = e
+	s.merkle.update(e.Key, e, s.store)
+
+	fields := log.FromContext(ctx, log.Fields{"node": s.addr, "key": e.Key, "vclock": s.vc})
 	if !e.Deleted {
-		log.Printf("Committed %q=%q at t=%v\n", e.Key, e.Value, s.vc)
+		fields["value"] = e.Value
+		log.Info("committed write", fields)
 	} else {
-		log.Printf("Committed delete of %q at t=%v\n", e.Key, s.vc)
+		log.Info("committed delete", fields)
 	}
 
 	if shouldJournal {
@@ -154,7 +174,7 @@ func (s *Store) commitWrite(e Entry, shouldJournal bool) (replaced bool) {
 }
 
 // Read returns the value for a key in the Store.
-func (s *Store) Read(tcausal clock.VectorClock, key string) (
+func (s *Store) Read(ctx context.Context, tcausal clock.VectorClock, key string) (
 	err error,
 	e Entry,
 	ok bool,
@@ -173,11 +193,13 @@ func (s *Store) Read(tcausal clock.VectorClock, key string) (
 	if e.Deleted {
 		ok = false
 	}
+
+	log.Debug("read", log.FromContext(ctx, log.Fields{"node": s.addr, "key": key, "op": "read", "found": ok}))
 	return
 }
 
 // NumKeys returns the number of keys in the store.
-func (s *Store) NumKeys(tcausal clock.VectorClock) (
+func (s *Store) NumKeys(ctx context.Context, tcausal clock.VectorClock) (
 	err error,
 	count int,
 	currentClock clock.VectorClock) {
@@ -198,6 +220,102 @@ func (s *Store) NumKeys(tcausal clock.VectorClock) (
 	return
 }
 
+// ApplyReplicated installs an entry that has already been ordered by an
+// external consensus protocol (see pkg/raft). Unlike Write/Delete it does not
+// wait on the causal vector clock: the caller is responsible for ensuring the
+// entry is applied in the order it was committed to the replicated log.
+func (s *Store) ApplyReplicated(ctx context.Context, e Entry) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.vc.Max(e.Clock)
+	s.commitWrite(ctx, e, false)
+}
+
+// MerkleRoot returns the root hash of the store's Merkle anti-entropy tree.
+// Two replicas with equal roots are guaranteed (modulo hash collisions) to
+// hold identical data; a mismatch means the caller should descend the tree
+// with MerkleNode to find which buckets differ, then fetch them with
+// BucketEntries.
+func (s *Store) MerkleRoot() []byte {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.merkle.root()
+}
+
+// MerkleNode returns the hash at an internal node of the tree, addressed by
+// the path of 'L'/'R' turns taken from the root to reach it. An empty path
+// refers to the root itself.
+func (s *Store) MerkleNode(path string) ([]byte, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.merkle.node(path)
+}
+
+// BucketForPath converts a full-depth Merkle leaf path (as addressed by
+// MerkleNode) into the bucket index BucketEntries expects, so a peer that
+// has descended the tree to a mismatched leaf can fetch that bucket's data.
+func BucketForPath(path string) (int, error) {
+	return bucketForPath(path)
+}
+
+// BucketEntries returns every Entry (including tombstones) whose key hashes
+// into the given bucket, for a peer to reconcile once anti-entropy has
+// narrowed a mismatch down to a single leaf.
+func (s *Store) BucketEntries(bucketID int) ([]Entry, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if bucketID < 0 || bucketID >= numBuckets {
+		return nil, fmt.Errorf("bucket %d out of range [0, %d)", bucketID, numBuckets)
+	}
+
+	entries := make([]Entry, 0, len(s.merkle.keys[bucketID]))
+	for key := range s.merkle.keys[bucketID] {
+		entries = append(entries, s.store[key])
+	}
+	return entries, nil
+}
+
+// Snapshot is a full copy of a store's data and vector clock, for catching
+// up a replica (e.g. via raft.Node's install-snapshot path) that has fallen
+// too far behind to replay one log entry at a time.
+type Snapshot struct {
+	Store map[string]Entry  `json:"store"`
+	Clock clock.VectorClock `json:"clock"`
+}
+
+// Snapshot captures the store's entire data map and vector clock as of now.
+func (s *Store) Snapshot() Snapshot {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	cp := make(map[string]Entry, len(s.store))
+	for k, v := range s.store {
+		cp[k] = v
+	}
+	return Snapshot{Store: cp, Clock: s.vc.Copy()}
+}
+
+// Restore replaces the store's entire data map, vector clock and Merkle tree
+// with snap's contents. It is for installing a snapshot wholesale, not for
+// merging; any data not in snap is discarded.
+func (s *Store) Restore(ctx context.Context, snap Snapshot) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.store = make(map[string]Entry, len(snap.Store))
+	s.merkle = newMerkleTree()
+	for k, v := range snap.Store {
+		s.store[k] = v
+		s.merkle.update(k, v, s.store)
+	}
+	s.vc = snap.Clock.Copy()
+	s.vcCond.Broadcast()
+
+	log.Info("restored store from snapshot", log.FromContext(ctx, log.Fields{"node": s.addr, "keys": len(snap.Store)}))
+}
+
 // SetReplicas replaces the current replicas list this store thinks it is on.
 func (s *Store) SetReplicas(nodes []string) {
 	s.m.Lock()